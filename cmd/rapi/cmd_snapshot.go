@@ -2,13 +2,18 @@ package main
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/briandowns/spinner"
 	"github.com/dustin/go-humanize"
 	"github.com/minio/sha256-simd"
-	"github.com/rubiojr/rapi/internal/walker"
 	"github.com/rubiojr/rapi/restic"
 	"github.com/urfave/cli/v2"
 )
@@ -19,9 +24,44 @@ func init() {
 		Usage: "Snapshot operations",
 		Subcommands: []*cli.Command{
 			&cli.Command{
-				Name:   "info",
-				Action: printSnapshotInfo,
-				Flags:  []cli.Flag{},
+				Name:      "info",
+				Usage:     "Show statistics about one or more snapshots",
+				ArgsUsage: "[snapshotID ...]",
+				Action:    printSnapshotInfo,
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "mode",
+						Value: countModeRestoreSize,
+						Usage: fmt.Sprintf(
+							"count mode, one of (%s, %s, %s, %s)",
+							countModeRestoreSize,
+							countModeUniqueFilesByContents,
+							countModeRawData,
+							countModeBlobsPerFile,
+						),
+					},
+					&cli.StringSliceFlag{
+						Name:  "host",
+						Usage: "only consider snapshots for this host (can be specified multiple times)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "tag",
+						Usage: "only consider snapshots with this tag (can be specified multiple times)",
+					},
+					&cli.StringSliceFlag{
+						Name:  "path",
+						Usage: "only consider snapshots for this path (can be specified multiple times)",
+					},
+					&cli.BoolFlag{
+						Name:  "json",
+						Usage: "print statistics as a JSON object instead of a human-readable table",
+					},
+					&cli.IntFlag{
+						Name:  "concurrency",
+						Value: runtime.GOMAXPROCS(0),
+						Usage: "number of tree loads to run concurrently",
+					},
+				},
 			},
 		},
 	}
@@ -32,94 +72,288 @@ func printSnapshotInfo(c *cli.Context) error {
 	var err error
 	ctx := context.Background()
 
+	mode := c.String("mode")
+	switch mode {
+	case countModeRestoreSize, countModeUniqueFilesByContents, countModeRawData, countModeBlobsPerFile:
+		// valid mode
+	default:
+		return fmt.Errorf("unknown mode %q, must be one of (%s, %s, %s, %s)",
+			mode, countModeRestoreSize, countModeUniqueFilesByContents, countModeRawData, countModeBlobsPerFile)
+	}
+
 	if err = rapiRepo.LoadIndex(ctx); err != nil {
 		return err
 	}
 
+	jsonOutput := c.Bool("json")
+
 	// create a container for the stats (and other needed state)
 	stats := &statsContainer{
-		uniqueFiles:    make(map[fileID]struct{}),
-		uniqueInodes:   make(map[uint64]struct{}),
-		fileBlobs:      make(map[string]restic.IDSet),
-		blobs:          restic.NewBlobSet(),
-		snapshotsCount: 0,
+		Mode:         mode,
+		uniqueFiles:  make(map[fileID]struct{}),
+		uniqueInodes: make(map[inodeKey]struct{}),
+		fileBlobs:    make(map[string]restic.IDSet),
+		FileSizes:    make(map[string]uint64),
+		blobs:        restic.NewBlobSet(),
 	}
 
-	s := spinner.New(spinner.CharSets[11], 100*time.Millisecond)
-	s.Color("fgHiRed")
-	s.Suffix = " Calculating snapshot stats, this may take some time"
-	s.Start()
-
-	sid, err := restic.FindLatestSnapshot(ctx, rapiRepo, []string{}, []restic.TagList{}, []string{})
+	snapshots, err := findSnapshotsForInfo(ctx, rapiRepo, c.Args().Slice(), c.StringSlice("host"), c.StringSlice("tag"), c.StringSlice("path"))
 	if err != nil {
 		return err
 	}
-	sn, err := restic.LoadSnapshot(ctx, rapiRepo, sid)
-	if err != nil {
-		return err
+
+	concurrency := c.Int("concurrency")
+	if concurrency < 1 {
+		concurrency = 1
 	}
 
-	err = statsWalkSnapshot(ctx, sn, rapiRepo, stats)
-	if err != nil {
-		return fmt.Errorf("error walking snapshot: %v", err)
+	var s *spinner.Spinner
+	if !jsonOutput {
+		s = spinner.New(spinner.CharSets[11], 100*time.Millisecond)
+		s.Color("fgHiRed")
+		s.Suffix = " Calculating snapshot stats, this may take some time"
+		s.Start()
 	}
 
+	if mode == countModeRawData {
+		err = statsFindUsedBlobsConcurrent(ctx, rapiRepo, snapshots, stats, concurrency)
+	} else {
+		err = statsWalkSnapshotsConcurrent(ctx, snapshots, rapiRepo, stats, mode, concurrency)
+	}
 	if err != nil {
-		return err
+		return fmt.Errorf("error walking snapshots: %v", err)
 	}
-
-	// the blob handles have been collected, but not yet counted
-	for blobHandle := range stats.blobs {
-		blobSize, found := rapiRepo.LookupBlobSize(blobHandle.ID, blobHandle.Type)
-		if !found {
-			return fmt.Errorf("blob %v not found", blobHandle)
+	stats.SnapshotsCount = len(snapshots)
+
+	// the blob handles have been collected (and unioned across every
+	// snapshot processed above), but not yet counted
+	if mode == countModeRawData {
+		for blobHandle := range stats.blobs {
+			blobSize, found := rapiRepo.LookupBlobSize(blobHandle.ID, blobHandle.Type)
+			if !found {
+				return fmt.Errorf("blob %v not found", blobHandle)
+			}
+			stats.TotalBlobSize += uint64(blobSize)
+			stats.TotalBlobCount++
 		}
-		stats.TotalBlobSize += uint64(blobSize)
-		stats.TotalBlobCount++
 	}
 
-	s.Stop()
-	printRow("Total Blob Count", fmt.Sprintf("%d", stats.TotalBlobCount), headerColor)
-	printRow(
-		"Unique Files Size",
-		humanize.Bytes(stats.TotalBlobSize)+fmt.Sprintf(" (deduped %s)", humanize.Bytes(stats.RestoreSize-stats.TotalBlobSize)),
-		headerColor,
-	)
-	printRow("Total Files", fmt.Sprintf("%d", stats.TotalFileCount), headerColor)
-	printRow("Unique Files", fmt.Sprintf("%d", stats.UniqueFileCount), headerColor)
-	printRow("Restore Size", humanize.Bytes(stats.RestoreSize), headerColor)
+	if !jsonOutput {
+		s.Stop()
+	}
+
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(stats)
+	}
+
+	printRow("Snapshots processed", fmt.Sprintf("%d", stats.SnapshotsCount), headerColor)
+	printStatsForMode(mode, stats)
 
 	return nil
 }
 
-func statsWalkSnapshot(ctx context.Context, snapshot *restic.Snapshot, repo restic.Repository, stats *statsContainer) error {
-	if snapshot.Tree == nil {
-		return fmt.Errorf("snapshot %s has nil tree", snapshot.ID().Str())
+// findSnapshotsForInfo resolves the snapshot IDs and filters given to
+// `snapshot info` into the list of snapshots that should be
+// processed. When no snapshot IDs are given, it defaults to just the
+// latest snapshot, same as before multi-snapshot support was added.
+func findSnapshotsForInfo(ctx context.Context, repo restic.Repository, ids []string, hosts, tags, paths []string) ([]*restic.Snapshot, error) {
+	if len(ids) == 0 {
+		ids = []string{"latest"}
 	}
 
-	// count just the sizes of unique blobs; we don't need to walk the tree
-	// ourselves in this case, since a nifty function does it for us
-	restic.FindUsedBlobs(ctx, repo, *snapshot.Tree, stats.blobs)
+	var snapshots []*restic.Snapshot
+	for sn := range restic.FindFilteredSnapshots(ctx, repo, hosts, parseTagLists(tags), paths, ids) {
+		snapshots = append(snapshots, sn)
+	}
 
-	err := walker.Walk(ctx, repo, *snapshot.Tree, restic.NewIDSet(), statsWalkTree(repo, stats))
-	if err != nil {
-		return fmt.Errorf("walking tree %s: %v", *snapshot.Tree, err)
+	if len(snapshots) == 0 {
+		return nil, fmt.Errorf("no snapshots matched the given filters")
 	}
 
-	return nil
+	return snapshots, nil
 }
 
-func statsWalkTree(repo restic.Repository, stats *statsContainer) walker.WalkFunc {
-	return func(parentTreeID restic.ID, npath string, node *restic.Node, nodeErr error) (bool, error) {
-		if nodeErr != nil {
-			return true, nodeErr
+// parseTagLists turns the flat list of values passed via --tag into
+// the OR-of-AND-groups shape restic.TagList filtering expects: each
+// value may itself be a comma-separated list of tags that must all
+// be present on a snapshot for it to match.
+func parseTagLists(tags []string) []restic.TagList {
+	tagLists := make([]restic.TagList, 0, len(tags))
+	for _, tag := range tags {
+		tagLists = append(tagLists, restic.TagList(strings.Split(tag, ",")))
+	}
+	return tagLists
+}
+
+// printStatsForMode prints only the fields relevant to the given count mode.
+func printStatsForMode(mode string, stats *statsContainer) {
+	switch mode {
+	case countModeRestoreSize:
+		printRow("Restore Size", humanize.Bytes(stats.RestoreSize), headerColor)
+	case countModeUniqueFilesByContents:
+		printRow("Total Files", fmt.Sprintf("%d", stats.TotalFileCount), headerColor)
+		printRow("Unique Files", fmt.Sprintf("%d", stats.UniqueFileCount), headerColor)
+		printRow("Unique Files Size", humanize.Bytes(stats.TotalSize), headerColor)
+	case countModeRawData:
+		printRow("Total Blob Count", fmt.Sprintf("%d", stats.TotalBlobCount), headerColor)
+		printRow("Raw Data Size", humanize.Bytes(stats.TotalBlobSize), headerColor)
+	case countModeBlobsPerFile:
+		paths := make([]string, 0, len(stats.fileBlobs))
+		for path := range stats.fileBlobs {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		for _, path := range paths {
+			printRow(path, humanize.Bytes(stats.FileSizes[path]), headerColor)
 		}
-		if node == nil {
-			return true, nil
+	}
+}
+
+// treeLoader is the subset of restic.Repository the concurrent tree
+// walk needs. Narrowing to just these two methods keeps the walk easy
+// to exercise on its own, e.g. in the benchmarks in
+// cmd_snapshot_bench_test.go, without standing up a full repository.
+type treeLoader interface {
+	LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error)
+	LookupBlobSize(id restic.ID, t restic.BlobType) (uint64, bool)
+}
+
+// statsWalkSnapshotsConcurrent walks the trees of every given snapshot,
+// running up to concurrency tree loads at a time. The visited set is
+// shared across all snapshots, so a subtree referenced by more than one
+// of them is only loaded and counted once.
+func statsWalkSnapshotsConcurrent(ctx context.Context, snapshots []*restic.Snapshot, repo treeLoader, stats *statsContainer, mode string, concurrency int) error {
+	for _, snapshot := range snapshots {
+		if snapshot.Tree == nil {
+			return fmt.Errorf("snapshot %s has nil tree", snapshot.ID().Str())
+		}
+	}
+
+	visited := newSyncIDSet()
+	sem := make(chan struct{}, concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for _, snapshot := range snapshots {
+		snapshot := snapshot
+
+		// sem is acquired here, at the spawn site, rather than around
+		// just the LoadTree call inside. This loop holds no slot of its
+		// own, so unlike the subtree spawns in statsWalkTreeConcurrent
+		// it can block until a slot frees up without deadlocking, and
+		// it never walks a tree itself.
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := statsWalkTreeConcurrent(ctx, repo, *snapshot.Tree, "/", stats, mode, snapshot.Hostname, visited, sem); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// statsWalkTreeConcurrent loads the tree at treeID and recurses into its
+// subtrees. host is the hostname of the snapshot this tree belongs to,
+// needed to scope restore-size's hard-link dedup to a single machine's
+// filesystem.
+//
+// sem bounds how many subtree walks run concurrently: spawning a
+// goroutine for a subtree requires acquiring a slot first (non-blocking
+// — see below), so a directory with far more children than
+// --concurrency never fans out more than sem's capacity worth of live
+// goroutines at once. Acquisition is non-blocking and falls back to
+// walking the subtree inline in the current goroutine when the pool is
+// full, rather than blocking on sem: a blocking acquire here would let
+// a parent, which already holds a slot for an ancestor call, deadlock
+// waiting for a slot to recurse into its own children.
+func statsWalkTreeConcurrent(ctx context.Context, repo treeLoader, treeID restic.ID, npath string, stats *statsContainer, mode string, host string, visited *syncIDSet, sem chan struct{}) error {
+	// blobs-per-file output is keyed by path, not content, so a tree
+	// reachable via more than one path (a renamed directory between
+	// snapshots, or two identical directories in the same snapshot)
+	// must still be walked once per path. Only the aggregate modes,
+	// which dedup by content/inode rather than path, can safely skip
+	// a tree they've already visited.
+	if mode != countModeBlobsPerFile && visited.visit(treeID) {
+		return nil
+	}
+
+	tree, err := repo.LoadTree(ctx, treeID)
+	if err != nil {
+		return fmt.Errorf("loading tree %s: %v", treeID, err)
+	}
+
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for _, node := range tree.Nodes {
+		path := npath + node.Name
+
+		if err := statsVisitNode(repo, stats, mode, host, path, node); err != nil {
+			errOnce.Do(func() { firstErr = err })
+			continue
+		}
+
+		if node.Subtree == nil {
+			continue
+		}
+
+		subtree := *node.Subtree
+		subpath := path + "/"
+
+		select {
+		case sem <- struct{}{}:
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				if err := statsWalkTreeConcurrent(ctx, repo, subtree, subpath, stats, mode, host, visited, sem); err != nil {
+					errOnce.Do(func() { firstErr = err })
+				}
+			}()
+		default:
+			// pool is full; walk this subtree inline rather than
+			// spawning (and blocking on) another goroutine
+			if err := statsWalkTreeConcurrent(ctx, repo, subtree, subpath, stats, mode, host, visited, sem); err != nil {
+				errOnce.Do(func() { firstErr = err })
+			}
+		}
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// statsVisitNode updates stats with a single node's contribution,
+// according to mode. It's called concurrently by multiple tree-walking
+// goroutines, so every update to stats is guarded by stats.mu. host
+// scopes restore-size's hard-link dedup to the snapshot's machine.
+func statsVisitNode(repo treeLoader, stats *statsContainer, mode string, host string, npath string, node *restic.Node) error {
+	switch mode {
+	case countModeUniqueFilesByContents:
+		if node.Type != "file" {
+			return nil
 		}
 
-		// only count this file if we haven't visited it before
 		fid := makeFileIDByContents(node)
+
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+
+		stats.TotalFileCount++
+
+		// only count this file if we haven't visited it before
 		if _, ok := stats.uniqueFiles[fid]; !ok {
 			// mark the file as visited
 			stats.uniqueFiles[fid] = struct{}{}
@@ -128,18 +362,135 @@ func statsWalkTree(repo restic.Repository, stats *statsContainer) walker.WalkFun
 			stats.TotalSize += node.Size
 			stats.UniqueFileCount++
 		}
+	case countModeBlobsPerFile:
+		if node.Type != "file" {
+			return nil
+		}
 
-		stats.TotalFileCount++
+		stats.mu.Lock()
+		blobs, ok := stats.fileBlobs[npath]
+		if !ok {
+			blobs = restic.NewIDSet()
+			stats.fileBlobs[npath] = blobs
+		}
+		var newBlobs []restic.ID
+		for _, blobID := range node.Content {
+			if blobs.Has(blobID) {
+				continue
+			}
+			blobs.Insert(blobID)
+			newBlobs = append(newBlobs, blobID)
+		}
+		stats.mu.Unlock()
+
+		// look up blob sizes without holding stats.mu, since
+		// LookupBlobSize may need to hit the backend
+		for _, blobID := range newBlobs {
+			size, found := repo.LookupBlobSize(blobID, restic.DataBlob)
+			if !found {
+				return fmt.Errorf("blob %s not found for file %q", blobID, npath)
+			}
+
+			stats.mu.Lock()
+			stats.FileSizes[npath] += uint64(size)
+			stats.mu.Unlock()
+		}
+	default: // countModeRestoreSize
+		// symlinks and directories don't take up restore space of
+		// their own; only files do
+		if node.Type != "file" {
+			return nil
+		}
 
-		// if inodes are present, only count each inode once
-		// (hard links do not increase restore size)
-		if _, ok := stats.uniqueInodes[node.Inode]; !ok || node.Inode == 0 {
-			stats.uniqueInodes[node.Inode] = struct{}{}
+		stats.mu.Lock()
+		defer stats.mu.Unlock()
+
+		// if inodes are present, only count each inode once per
+		// host/device (hard links do not increase restore size).
+		// Inode numbers are only unique within a single filesystem,
+		// so the host and device both have to be part of the key:
+		// snapshots from different hosts/devices can otherwise share
+		// inode numbers for unrelated files.
+		key := inodeKey{host: host, deviceID: node.DeviceID, inode: node.Inode}
+		if _, ok := stats.uniqueInodes[key]; !ok || node.Inode == 0 {
+			stats.uniqueInodes[key] = struct{}{}
 			stats.RestoreSize += node.Size
 		}
+	}
 
-		return true, nil
+	return nil
+}
+
+// statsFindUsedBlobsConcurrent runs restic.FindUsedBlobs for every given
+// snapshot concurrently (bounded by concurrency) and unions the results
+// into stats.blobs.
+func statsFindUsedBlobsConcurrent(ctx context.Context, repo restic.Repository, snapshots []*restic.Snapshot, stats *statsContainer, concurrency int) error {
+	for _, snapshot := range snapshots {
+		if snapshot.Tree == nil {
+			return fmt.Errorf("snapshot %s has nil tree", snapshot.ID().Str())
+		}
+	}
+
+	sem := make(chan struct{}, concurrency)
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		errOnce  sync.Once
+		firstErr error
+	)
+
+	for _, snapshot := range snapshots {
+		snapshot := snapshot
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			// each worker gets its own blob set, since restic.BlobSet
+			// isn't safe for concurrent writes; the sets are unioned
+			// into stats.blobs under mu below
+			blobs := restic.NewBlobSet()
+			if err := restic.FindUsedBlobs(ctx, repo, *snapshot.Tree, blobs); err != nil {
+				errOnce.Do(func() { firstErr = err })
+				return
+			}
+
+			mu.Lock()
+			for b := range blobs {
+				stats.blobs.Insert(b)
+			}
+			mu.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	return firstErr
+}
+
+// syncIDSet is a restic.IDSet that can be shared across goroutines.
+type syncIDSet struct {
+	mu  sync.Mutex
+	ids restic.IDSet
+}
+
+func newSyncIDSet() *syncIDSet {
+	return &syncIDSet{ids: restic.NewIDSet()}
+}
+
+// visit marks id as visited and reports whether it had already been
+// visited by a previous caller.
+func (s *syncIDSet) visit(id restic.ID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ids.Has(id) {
+		return true
 	}
+	s.ids.Insert(id)
+	return false
 }
 
 // makeFileIDByContents returns a hash of the blob IDs of the
@@ -156,36 +507,59 @@ func makeFileIDByContents(node *restic.Node) fileID {
 // to collect information about it, as well as state needed
 // for a successful and efficient walk.
 type statsContainer struct {
-	TotalSize       uint64 `json:"total_size"`
-	RestoreSize     uint64 `json:"total_size"`
-	TotalFileCount  uint64 `json:"total_file_count"`
-	UniqueFileCount uint64 `json:"total_file_count"`
+	// Mode is the count mode that produced this container's fields.
+	Mode string `json:"mode"`
+
+	// SnapshotsCount is the number of snapshots that were processed.
+	SnapshotsCount int `json:"snapshots_count"`
+
+	TotalSize       uint64 `json:"total_size,omitempty"`
+	RestoreSize     uint64 `json:"restore_size,omitempty"`
+	TotalFileCount  uint64 `json:"total_file_count,omitempty"`
+	UniqueFileCount uint64 `json:"unique_file_count,omitempty"`
 	TotalBlobCount  uint64 `json:"total_blob_count,omitempty"`
-	TotalBlobSize   uint64 `json:"total_blob_count,omitempty"`
+	TotalBlobSize   uint64 `json:"total_blob_size,omitempty"`
 
 	// uniqueFiles marks visited files according to their
 	// contents (hashed sequence of content blob IDs)
 	uniqueFiles map[fileID]struct{}
 
 	// uniqueInodes marks visited files according to their
-	// inode # (hashed sequence of inode numbers)
-	uniqueInodes map[uint64]struct{}
+	// (host, device, inode) triple
+	uniqueInodes map[inodeKey]struct{}
 
 	// fileBlobs maps a file name (path) to the set of
 	// blobs that have been seen as a part of the file
 	fileBlobs map[string]restic.IDSet
 
+	// FileSizes maps a file name (path) to the sum of the
+	// sizes of the blobs in fileBlobs, i.e. the size
+	// attributable to that file in blobs-per-file mode
+	FileSizes map[string]uint64 `json:"file_sizes,omitempty"`
+
 	// blobs is used to count individual unique blobs,
 	// independent of references to files
 	blobs restic.BlobSet
 
-	// holds count of all considered snapshots
-	snapshotsCount int
+	// mu guards every field above while multiple tree-walking
+	// goroutines are updating this container concurrently
+	mu sync.Mutex
 }
 
 // fileID is a 256-bit hash that distinguishes unique files.
 type fileID [32]byte
 
+// inodeKey distinguishes an inode within the scope of a single host's
+// filesystem. Inode numbers are only unique per device, and device
+// numbers are only unique per host, so all three have to be combined
+// to dedup hard links across a run that aggregates snapshots from
+// more than one host or device.
+type inodeKey struct {
+	host     string
+	deviceID uint64
+	inode    uint64
+}
+
 const (
 	countModeRestoreSize           = "restore-size"
 	countModeUniqueFilesByContents = "files-by-contents"
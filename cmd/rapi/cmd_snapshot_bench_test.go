@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"testing"
+
+	"github.com/rubiojr/rapi/restic"
+)
+
+// fakeTreeLoader is an in-memory treeLoader backed by a pre-built set
+// of trees, so the concurrent walk can be benchmarked without a real
+// repository or backend.
+type fakeTreeLoader struct {
+	trees map[restic.ID]*restic.Tree
+}
+
+func (f *fakeTreeLoader) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	tree, ok := f.trees[id]
+	if !ok {
+		return nil, fmt.Errorf("tree %s not found", id)
+	}
+	return tree, nil
+}
+
+func (f *fakeTreeLoader) LookupBlobSize(id restic.ID, t restic.BlobType) (uint64, bool) {
+	return 4096, true
+}
+
+// benchID derives a deterministic, unique restic.ID from n so the
+// benchmark fixture doesn't depend on math/rand or time.
+func benchID(n int) restic.ID {
+	var id restic.ID
+	binary.BigEndian.PutUint64(id[:8], uint64(n))
+	return id
+}
+
+// buildBenchTree builds a depth/fanout tree of directories, in which
+// each directory above the bottom level holds fanout subdirectories
+// and each bottom-level directory holds fanout files, registering
+// every tree it creates in trees, and returns the ID of the tree it
+// built.
+func buildBenchTree(depth, fanout int, next *int, trees map[restic.ID]*restic.Tree) restic.ID {
+	tree := &restic.Tree{}
+
+	for i := 0; i < fanout; i++ {
+		if depth == 0 {
+			contentID := benchID(*next)
+			*next++
+			tree.Nodes = append(tree.Nodes, &restic.Node{
+				Name:    fmt.Sprintf("file%d", i),
+				Type:    "file",
+				Size:    4096,
+				Inode:   uint64(*next),
+				Content: []restic.ID{contentID},
+			})
+			continue
+		}
+
+		childID := buildBenchTree(depth-1, fanout, next, trees)
+		tree.Nodes = append(tree.Nodes, &restic.Node{
+			Name:    fmt.Sprintf("dir%d", i),
+			Type:    "dir",
+			Subtree: &childID,
+		})
+	}
+
+	id := benchID(*next)
+	*next++
+	trees[id] = tree
+	return id
+}
+
+func benchmarkStatsWalkTreeConcurrent(b *testing.B, mode string, concurrency int) {
+	trees := make(map[restic.ID]*restic.Tree)
+	next := 0
+	rootID := buildBenchTree(4, 8, &next, trees)
+	loader := &fakeTreeLoader{trees: trees}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		stats := &statsContainer{
+			uniqueFiles:  make(map[fileID]struct{}),
+			uniqueInodes: make(map[inodeKey]struct{}),
+			fileBlobs:    make(map[string]restic.IDSet),
+			FileSizes:    make(map[string]uint64),
+		}
+		sem := make(chan struct{}, concurrency)
+		visited := newSyncIDSet()
+
+		// the root walk holds a slot of its own, as it does when
+		// statsWalkSnapshotsConcurrent spawns it, so at most
+		// concurrency walks run at once
+		sem <- struct{}{}
+		err := statsWalkTreeConcurrent(context.Background(), loader, rootID, "/", stats, mode, "bench-host", visited, sem)
+		<-sem
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStatsWalkTreeConcurrentSerial pins concurrency at 1, the
+// equivalent of the old single-threaded walker.Walk-based path, so it
+// can be compared against the parallel benchmark below.
+func BenchmarkStatsWalkTreeConcurrentSerial(b *testing.B) {
+	benchmarkStatsWalkTreeConcurrent(b, countModeRestoreSize, 1)
+}
+
+func BenchmarkStatsWalkTreeConcurrentParallel(b *testing.B) {
+	benchmarkStatsWalkTreeConcurrent(b, countModeRestoreSize, runtime.GOMAXPROCS(0))
+}
+
+func BenchmarkStatsWalkTreeConcurrentBlobsPerFileSerial(b *testing.B) {
+	benchmarkStatsWalkTreeConcurrent(b, countModeBlobsPerFile, 1)
+}
+
+func BenchmarkStatsWalkTreeConcurrentBlobsPerFileParallel(b *testing.B) {
+	benchmarkStatsWalkTreeConcurrent(b, countModeBlobsPerFile, runtime.GOMAXPROCS(0))
+}
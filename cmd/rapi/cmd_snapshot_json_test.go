@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"sort"
+	"testing"
+)
+
+// TestStatsContainerJSONPerMode checks that encoding a statsContainer
+// produces exactly the JSON keys relevant to its mode: the shared
+// mode/snapshots_count keys, the fields that mode's printStatsForMode
+// reads, and nothing else, since omitempty is what keeps unrelated
+// modes' fields out of scripted consumers' output.
+func TestStatsContainerJSONPerMode(t *testing.T) {
+	tests := []struct {
+		mode string
+		// populate fills in only the fields that mode actually
+		// produces a non-zero value for, mirroring what a real walk
+		// would leave behind
+		populate func(*statsContainer)
+		wantKeys []string
+	}{
+		{
+			mode: countModeRestoreSize,
+			populate: func(s *statsContainer) {
+				s.RestoreSize = 1024
+			},
+			wantKeys: []string{"mode", "snapshots_count", "restore_size"},
+		},
+		{
+			mode: countModeUniqueFilesByContents,
+			populate: func(s *statsContainer) {
+				s.TotalSize = 2048
+				s.TotalFileCount = 3
+				s.UniqueFileCount = 2
+			},
+			wantKeys: []string{"mode", "snapshots_count", "total_size", "total_file_count", "unique_file_count"},
+		},
+		{
+			mode: countModeRawData,
+			populate: func(s *statsContainer) {
+				s.TotalBlobCount = 5
+				s.TotalBlobSize = 4096
+			},
+			wantKeys: []string{"mode", "snapshots_count", "total_blob_count", "total_blob_size"},
+		},
+		{
+			mode: countModeBlobsPerFile,
+			populate: func(s *statsContainer) {
+				s.FileSizes["/a"] = 100
+				s.FileSizes["/b"] = 200
+			},
+			wantKeys: []string{"mode", "snapshots_count", "file_sizes"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			stats := newTestStatsContainer(tt.mode)
+			stats.SnapshotsCount = 1
+			tt.populate(stats)
+
+			data, err := json.Marshal(stats)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var decoded map[string]json.RawMessage
+			if err := json.Unmarshal(data, &decoded); err != nil {
+				t.Fatal(err)
+			}
+
+			gotKeys := make([]string, 0, len(decoded))
+			for k := range decoded {
+				gotKeys = append(gotKeys, k)
+			}
+			sort.Strings(gotKeys)
+
+			wantKeys := append([]string(nil), tt.wantKeys...)
+			sort.Strings(wantKeys)
+
+			if len(gotKeys) != len(wantKeys) {
+				t.Fatalf("keys = %v, want %v", gotKeys, wantKeys)
+			}
+			for i := range gotKeys {
+				if gotKeys[i] != wantKeys[i] {
+					t.Fatalf("keys = %v, want %v", gotKeys, wantKeys)
+				}
+			}
+		})
+	}
+}
+
+// TestStatsContainerJSONFileSizesRoundTrip checks that blobs-per-file's
+// file_sizes field round-trips through JSON intact, since it's the one
+// mode-specific field that isn't a scalar.
+func TestStatsContainerJSONFileSizesRoundTrip(t *testing.T) {
+	stats := newTestStatsContainer(countModeBlobsPerFile)
+	stats.SnapshotsCount = 1
+	stats.FileSizes["/a/b"] = 123
+	stats.FileSizes["/c"] = 456
+
+	data, err := json.Marshal(stats)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		FileSizes map[string]uint64 `json:"file_sizes"`
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.FileSizes) != len(stats.FileSizes) {
+		t.Fatalf("file_sizes = %v, want %v", decoded.FileSizes, stats.FileSizes)
+	}
+	for path, size := range stats.FileSizes {
+		if decoded.FileSizes[path] != size {
+			t.Errorf("file_sizes[%q] = %d, want %d", path, decoded.FileSizes[path], size)
+		}
+	}
+}
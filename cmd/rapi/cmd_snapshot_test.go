@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rubiojr/rapi/restic"
+)
+
+// newTestStatsContainer returns a statsContainer with every map field
+// initialized, the same way printSnapshotInfo sets one up.
+func newTestStatsContainer(mode string) *statsContainer {
+	return &statsContainer{
+		Mode:         mode,
+		uniqueFiles:  make(map[fileID]struct{}),
+		uniqueInodes: make(map[inodeKey]struct{}),
+		fileBlobs:    make(map[string]restic.IDSet),
+		FileSizes:    make(map[string]uint64),
+		blobs:        restic.NewBlobSet(),
+	}
+}
+
+// buildSharedSubtreeFixture builds two root trees that both link to the
+// same subtree (commonID) under different names, simulating two
+// snapshots that happen to share a directory. It returns the IDs of the
+// two roots and the size of the single file the shared subtree holds.
+func buildSharedSubtreeFixture(trees map[restic.ID]*restic.Tree) (rootA, rootB restic.ID, fileSize uint64) {
+	fileSize = 100
+
+	commonID := benchID(1)
+	trees[commonID] = &restic.Tree{
+		Nodes: []*restic.Node{
+			{
+				Name:    "f",
+				Type:    "file",
+				Size:    fileSize,
+				Inode:   1,
+				Content: []restic.ID{benchID(2)},
+			},
+		},
+	}
+
+	rootA = benchID(3)
+	trees[rootA] = &restic.Tree{
+		Nodes: []*restic.Node{
+			{Name: "shared", Type: "dir", Subtree: &commonID},
+		},
+	}
+
+	rootB = benchID(4)
+	trees[rootB] = &restic.Tree{
+		Nodes: []*restic.Node{
+			{Name: "other", Type: "dir", Subtree: &commonID},
+		},
+	}
+
+	return rootA, rootB, fileSize
+}
+
+func TestStatsWalkSnapshotsConcurrentDedupsSharedSubtree(t *testing.T) {
+	trees := make(map[restic.ID]*restic.Tree)
+	rootA, rootB, fileSize := buildSharedSubtreeFixture(trees)
+	loader := &fakeTreeLoader{trees: trees}
+
+	snapshots := []*restic.Snapshot{
+		{Tree: &rootA, Hostname: "h1"},
+		{Tree: &rootB, Hostname: "h1"},
+	}
+
+	stats := newTestStatsContainer(countModeRestoreSize)
+	if err := statsWalkSnapshotsConcurrent(context.Background(), snapshots, loader, stats, countModeRestoreSize, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// the shared subtree is reachable from both snapshots, but its tree
+	// ID is only ever visited once, so the file inside it must only be
+	// counted once even though it was reached via two different paths
+	if stats.RestoreSize != fileSize {
+		t.Errorf("RestoreSize = %d, want %d (shared subtree counted more than once)", stats.RestoreSize, fileSize)
+	}
+}
+
+func TestStatsWalkSnapshotsConcurrentDedupsFilesByContents(t *testing.T) {
+	trees := make(map[restic.ID]*restic.Tree)
+
+	// two files with identical contents (same content blob IDs) but
+	// different names/paths, each living in its own snapshot's root
+	contentBlob := benchID(1)
+
+	rootA := benchID(2)
+	trees[rootA] = &restic.Tree{
+		Nodes: []*restic.Node{
+			{Name: "a", Type: "file", Size: 50, Content: []restic.ID{contentBlob}},
+		},
+	}
+
+	rootB := benchID(3)
+	trees[rootB] = &restic.Tree{
+		Nodes: []*restic.Node{
+			{Name: "b", Type: "file", Size: 50, Content: []restic.ID{contentBlob}},
+		},
+	}
+
+	loader := &fakeTreeLoader{trees: trees}
+	snapshots := []*restic.Snapshot{
+		{Tree: &rootA, Hostname: "h1"},
+		{Tree: &rootB, Hostname: "h1"},
+	}
+
+	stats := newTestStatsContainer(countModeUniqueFilesByContents)
+	if err := statsWalkSnapshotsConcurrent(context.Background(), snapshots, loader, stats, countModeUniqueFilesByContents, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// both files are visited, but since they have identical contents
+	// they must only count as one unique file
+	if stats.TotalFileCount != 2 {
+		t.Errorf("TotalFileCount = %d, want 2", stats.TotalFileCount)
+	}
+	if stats.UniqueFileCount != 1 {
+		t.Errorf("UniqueFileCount = %d, want 1", stats.UniqueFileCount)
+	}
+	if stats.TotalSize != 50 {
+		t.Errorf("TotalSize = %d, want 50 (size of the single unique file)", stats.TotalSize)
+	}
+}
+
+func TestStatsWalkSnapshotsConcurrentKeepsPerPathBlobsForSharedSubtree(t *testing.T) {
+	trees := make(map[restic.ID]*restic.Tree)
+	rootA, rootB, _ := buildSharedSubtreeFixture(trees)
+	loader := &fakeTreeLoader{trees: trees}
+
+	snapshots := []*restic.Snapshot{
+		{Tree: &rootA, Hostname: "h1"},
+		{Tree: &rootB, Hostname: "h1"},
+	}
+
+	stats := newTestStatsContainer(countModeBlobsPerFile)
+	if err := statsWalkSnapshotsConcurrent(context.Background(), snapshots, loader, stats, countModeBlobsPerFile, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	// unlike restore-size, blobs-per-file is keyed by path rather than
+	// tree ID, so the shared subtree must be walked and reported once
+	// per path it's reachable from, not deduped away. FileSizes sums
+	// blob sizes, and fakeTreeLoader reports every blob as 4096 bytes,
+	// so each path is attributed its file's single 4096-byte blob.
+	want := map[string]uint64{
+		"/shared/f": 4096,
+		"/other/f":  4096,
+	}
+	if len(stats.FileSizes) != len(want) {
+		t.Fatalf("FileSizes = %v, want %v", stats.FileSizes, want)
+	}
+	for path, size := range want {
+		if got := stats.FileSizes[path]; got != size {
+			t.Errorf("FileSizes[%q] = %d, want %d", path, got, size)
+		}
+	}
+}
+
+// blobSizeTreeLoader is a treeLoader whose LookupBlobSize fails for a
+// configurable set of blob IDs, used to exercise the node-visit error
+// path of statsWalkTreeConcurrent.
+type blobSizeTreeLoader struct {
+	trees   map[restic.ID]*restic.Tree
+	missing map[restic.ID]bool
+}
+
+func (f *blobSizeTreeLoader) LoadTree(ctx context.Context, id restic.ID) (*restic.Tree, error) {
+	return f.trees[id], nil
+}
+
+func (f *blobSizeTreeLoader) LookupBlobSize(id restic.ID, t restic.BlobType) (uint64, bool) {
+	if f.missing[id] {
+		return 0, false
+	}
+	return 4096, true
+}
+
+// TestStatsWalkTreeConcurrentReturnsPromptlyOnNodeVisitError guards
+// against the goroutine leak fixed in 910ccd5: a node-visit error in one
+// subtree must not prevent the walk from returning once its sibling
+// goroutines finish.
+func TestStatsWalkTreeConcurrentReturnsPromptlyOnNodeVisitError(t *testing.T) {
+	trees := make(map[restic.ID]*restic.Tree)
+	badBlob := benchID(100)
+
+	const numDirs = 8
+	rootTree := &restic.Tree{}
+	for i := 0; i < numDirs; i++ {
+		content := []restic.ID{benchID(i)}
+		if i == 0 {
+			content = []restic.ID{badBlob}
+		}
+
+		dirID := benchID(200 + i)
+		trees[dirID] = &restic.Tree{
+			Nodes: []*restic.Node{
+				{Name: "f", Type: "file", Content: content},
+			},
+		}
+
+		id := dirID
+		rootTree.Nodes = append(rootTree.Nodes, &restic.Node{
+			Name: "dir", Type: "dir", Subtree: &id,
+		})
+	}
+
+	rootID := benchID(300)
+	trees[rootID] = rootTree
+
+	loader := &blobSizeTreeLoader{trees: trees, missing: map[restic.ID]bool{badBlob: true}}
+	stats := newTestStatsContainer(countModeBlobsPerFile)
+
+	// concurrency of 1 leaves a single slot, so while one subtree's
+	// goroutine holds it the other subtrees take the non-blocking
+	// select's inline fallback, the path most likely to hang if the
+	// fallback itself blocked on wg.Wait() incorrectly.
+	sem := make(chan struct{}, 1)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- statsWalkTreeConcurrent(context.Background(), loader, rootID, "/", stats, countModeBlobsPerFile, "h1", newSyncIDSet(), sem)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Fatal("expected an error from the missing blob, got nil")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("statsWalkTreeConcurrent did not return after a node-visit error — possible goroutine leak or deadlock")
+	}
+}